@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containers/image/copy"
 	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/signature"
 	"github.com/containers/image/transports"
 	"github.com/containers/image/transports/alltransports"
 	"github.com/containers/image/types"
+	encconfig "github.com/containers/ocicrypt/config"
+	enchelpers "github.com/containers/ocicrypt/helpers"
+	"github.com/docker/distribution/registry/api/errcode"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
@@ -32,10 +47,55 @@ func contextsFromGlobalOptions(c *cli.Context) (*types.SystemContext, *types.Sys
 }
 
 type copyOptions struct {
-	additionalTags    cli.StringSlice // For docker-archive: destinations, in addition to the name:tag specified as destination, also add these
-	removeSignatures  bool            // Do not copy signatures from the source image
-	signByFingerprint string          // Sign the image using a GPG key with the specified fingerprint
-	format            optionalString  // Force conversion of the image to a specified format
+	additionalTags               cli.StringSlice // For docker-archive: destinations, in addition to the name:tag specified as destination, also add these
+	removeSignatures             bool            // Do not copy signatures from the source image
+	signByFingerprint            string          // Sign the image using a GPG key with the specified fingerprint
+	signBySigstorePrivateKeyFile string          // Sign the image using a sigstore private key at the specified path
+	signPassphraseFile           string          // Path pointing to a passphrase file when signing with a sigstore private key
+	format                       optionalString  // Force conversion of the image to a specified format
+	encryptionKeys               cli.StringSlice // Keys needed to encrypt the image
+	decryptionKeys               cli.StringSlice // Keys needed to decrypt the image
+	encryptLayer                 cli.IntSlice    // Indices of the layers to encrypt
+	all                          bool            // Copy all of the images if SOURCE-IMAGE is a list
+	overrideOS                   string          // The OS to use for choosing an image instance from a source manifest list
+	overrideArch                 string          // The architecture to use for choosing an image instance from a source manifest list
+	overrideVariant              string          // The variant to use for choosing an image instance from a source manifest list
+	retryTimes                   int             // Number of times to retry the copy on a transient error
+	retryDelay                   time.Duration   // Initial delay between retries, doubling on each attempt
+	destCompressFormat           optionalString  // Format to use for compressing the destination's layers
+	destCompressLevel            optionalInt     // Compression level to use for the destination's layers
+}
+
+// optionalInt records an integer flag value together with whether it was set at all, the same
+// way optionalString does for string flags.
+type optionalInt struct {
+	present bool
+	value   int
+}
+
+// optionalIntValue adapts an *optionalInt to the cli.Generic interface, mirroring
+// newOptionalStringValue's wrapper for optionalString.
+type optionalIntValue optionalInt
+
+func newOptionalIntValue(p *optionalInt) cli.Generic {
+	return (*optionalIntValue)(p)
+}
+
+func (opt *optionalIntValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	opt.value = n
+	opt.present = true
+	return nil
+}
+
+func (opt *optionalIntValue) String() string {
+	if opt == nil || !opt.present {
+		return ""
+	}
+	return strconv.Itoa(opt.value)
 }
 
 func copyCmd() cli.Command {
@@ -75,6 +135,16 @@ func copyCmd() cli.Command {
 				Usage:       "Sign the image using a GPG key with the specified `FINGERPRINT`",
 				Destination: &opts.signByFingerprint,
 			},
+			cli.StringFlag{
+				Name:        "sign-by-sigstore-private-key",
+				Usage:       "Sign the image using a sigstore private key at `PATH`",
+				Destination: &opts.signBySigstorePrivateKeyFile,
+			},
+			cli.StringFlag{
+				Name:        "sign-passphrase-file",
+				Usage:       "`PATH` of a file that contains the passphrase for the --sign-by-sigstore-private-key private key (not used by --sign-by)",
+				Destination: &opts.signPassphraseFile,
+			},
 			cli.StringFlag{
 				Name:  "src-creds, screds",
 				Value: "",
@@ -123,9 +193,15 @@ func copyCmd() cli.Command {
 				Usage: "`MANIFEST TYPE` (oci, v2s1, or v2s2) to use when saving image to directory using the 'dir:' transport (default is manifest type of source)",
 				Value: newOptionalStringValue(&opts.format),
 			},
-			cli.BoolFlag{
-				Name:  "dest-compress",
-				Usage: "Compress tarball image layers when saving to directory using the 'dir' transport. (default is same compression type as source)",
+			cli.GenericFlag{
+				Name:  "dest-compress-format",
+				Usage: "`FORMAT` to compress the destination's layers with (gzip, zstd, or zstd:chunked). (default is same compression type as source)",
+				Value: newOptionalStringValue(&opts.destCompressFormat),
+			},
+			cli.GenericFlag{
+				Name:  "dest-compress-level",
+				Usage: "`LEVEL` to use for the compressor (e.g. 1-9 for gzip, 1-22 for zstd)",
+				Value: newOptionalIntValue(&opts.destCompressLevel),
 			},
 			cli.StringFlag{
 				Name:  "src-daemon-host",
@@ -137,10 +213,83 @@ func copyCmd() cli.Command {
 				Value: "",
 				Usage: "use docker daemon host at `HOST` (docker-daemon destinations only)",
 			},
+			cli.StringSliceFlag{
+				Name:  "encryption-key",
+				Usage: "`KEY` to use for encrypting the image (e.g. jwe:/path/to/key.pem). May be specified multiple times",
+				Value: &opts.encryptionKeys,
+			},
+			cli.IntSliceFlag{
+				Name:  "encrypt-layer",
+				Usage: "0-indexed layer indices to encrypt. If not specified, all layers will be encrypted",
+				Value: &opts.encryptLayer,
+			},
+			cli.StringSliceFlag{
+				Name:  "decryption-key",
+				Usage: "`KEY` needed to decrypt the image (e.g. /path/to/key.pem). May be specified multiple times; keys are tried in order until one succeeds",
+				Value: &opts.decryptionKeys,
+			},
+			cli.BoolFlag{
+				Name:        "all, a",
+				Usage:       "Copy all images if SOURCE-IMAGE is a list",
+				Destination: &opts.all,
+			},
+			cli.StringFlag{
+				Name:        "override-os",
+				Usage:       "use `OS` instead of the running OS for choosing images",
+				Destination: &opts.overrideOS,
+			},
+			cli.StringFlag{
+				Name:        "override-arch",
+				Usage:       "use `ARCH` instead of the architecture of the machine for choosing images",
+				Destination: &opts.overrideArch,
+			},
+			cli.StringFlag{
+				Name:        "override-variant",
+				Usage:       "use `VARIANT` instead of the running architecture variant for choosing images",
+				Destination: &opts.overrideVariant,
+			},
+			cli.IntFlag{
+				Name:        "retry-times",
+				Usage:       "the number of times to retry on a transient copy failure",
+				Destination: &opts.retryTimes,
+			},
+			cli.DurationFlag{
+				Name:        "retry-delay",
+				Value:       5 * time.Second,
+				Usage:       "the initial `DURATION` to wait between retries, doubling (with jitter) on each attempt",
+				Destination: &opts.retryDelay,
+			},
 		},
 	}
 }
 
+// dockerArchivePathWithoutTag strips the optional ":docker-reference" suffix a docker-archive
+// reference's StringWithinTransport can carry, leaving just the archive path.
+func dockerArchivePathWithoutTag(refString string) string {
+	if i := strings.Index(refString, ":"); i >= 0 {
+		return refString[:i]
+	}
+	return refString
+}
+
+// manifestTypeFromOptionalFormat translates a --format value into the manifest media type
+// copy.Options.ForceManifestMIMEType expects, leaving it empty when format wasn't given.
+func manifestTypeFromOptionalFormat(format optionalString) (string, error) {
+	if !format.present {
+		return "", nil
+	}
+	switch format.value {
+	case "oci":
+		return imgspecv1.MediaTypeImageManifest, nil
+	case "v2s1":
+		return manifest.DockerV2Schema1SignedMediaType, nil
+	case "v2s2":
+		return manifest.DockerV2Schema2MediaType, nil
+	default:
+		return "", fmt.Errorf("unknown format %q. Choose one of the supported formats: 'oci', 'v2s1', or 'v2s2'", format.value)
+	}
+}
+
 func (opts *copyOptions) run(c *cli.Context) error {
 	if len(c.Args()) != 2 {
 		cli.ShowCommandHelp(c, "copy")
@@ -167,18 +316,93 @@ func (opts *copyOptions) run(c *cli.Context) error {
 		return err
 	}
 
-	var manifestType string
-	if opts.format.present {
-		switch opts.format.value {
-		case "oci":
-			manifestType = imgspecv1.MediaTypeImageManifest
-		case "v2s1":
-			manifestType = manifest.DockerV2Schema1SignedMediaType
-		case "v2s2":
-			manifestType = manifest.DockerV2Schema2MediaType
-		default:
-			return fmt.Errorf("unknown format %q. Choose one of the supported formats: 'oci', 'v2s1', or 'v2s2'", opts.format.value)
+	ctx, cancel := commandTimeoutContextFromGlobalOptions(c)
+	defer cancel()
+
+	if opts.overrideOS != "" {
+		sourceCtx.OSChoice = opts.overrideOS
+	}
+	if opts.overrideArch != "" {
+		sourceCtx.ArchitectureChoice = opts.overrideArch
+	}
+	if opts.overrideVariant != "" {
+		sourceCtx.VariantChoice = opts.overrideVariant
+	}
+
+	imageListSelection := copy.CopySystemImage
+	if opts.all {
+		imageListSelection = copy.CopyAllImages
+		switch destRef.Transport().Name() {
+		case "dir", "docker-daemon":
+			return fmt.Errorf("--all is not supported for destination transport %q: it cannot represent a manifest list", destRef.Transport().Name())
+		case "docker-archive":
+			if filepath.Ext(dockerArchivePathWithoutTag(destRef.StringWithinTransport())) == "" {
+				return errors.New("--all is not supported for docker-archive destinations without a file extension: it cannot represent a manifest list")
+			}
+		}
+	}
+
+	manifestType, err := manifestTypeFromOptionalFormat(opts.format)
+	if err != nil {
+		return err
+	}
+
+	destManifestType := manifestType
+	if opts.destCompressFormat.present {
+		destManifestType, err = effectiveManifestType(ctx, sourceCtx, srcRef, manifestType)
+		if err != nil {
+			return err
+		}
+	}
+
+	destCompressionFormat, destCompressionLevel, err := destinationCompressionFromOptions(opts, destManifestType)
+	if err != nil {
+		return err
+	}
+
+	var passphrase string
+	if opts.signPassphraseFile != "" {
+		p, err := ioutil.ReadFile(opts.signPassphraseFile)
+		if err != nil {
+			return fmt.Errorf("error reading passphrase file %s: %v", opts.signPassphraseFile, err)
 		}
+		passphrase = strings.TrimSuffix(string(p), "\n")
+	}
+
+	var encLayers *[]int
+	var encConfig *encconfig.EncryptConfig
+	var decConfig *encconfig.DecryptConfig
+
+	if len(opts.encryptionKeys) > 0 && len(opts.decryptionKeys) > 0 {
+		return errors.New("cannot supply both --encryption-key and --decryption-key")
+	}
+
+	if len(opts.encryptionKeys) > 0 {
+		if destRef.Transport().Name() == "docker-daemon" {
+			return errors.New("encrypted layers cannot round-trip through the docker-daemon transport")
+		}
+		if manifestType != "" && manifestType != imgspecv1.MediaTypeImageManifest {
+			return errors.New("encryption is only supported when copying to an OCI manifest format")
+		}
+		p := []int(opts.encryptLayer)
+		encLayers = &p
+		encryptionKeys := []string(opts.encryptionKeys)
+		ecc, err := enchelpers.CreateCryptoConfig(encryptionKeys, []string{})
+		if err != nil {
+			return fmt.Errorf("invalid encryption keys: %v", err)
+		}
+		cc := encconfig.CombineCryptoConfigs([]encconfig.CryptoConfig{ecc})
+		encConfig = cc.EncryptConfig
+	}
+
+	if len(opts.decryptionKeys) > 0 {
+		decryptionKeys := []string(opts.decryptionKeys)
+		dcc, err := enchelpers.CreateCryptoConfig([]string{}, decryptionKeys)
+		if err != nil {
+			return fmt.Errorf("invalid decryption keys: %v", err)
+		}
+		cc := encconfig.CombineCryptoConfigs([]encconfig.CryptoConfig{dcc})
+		decConfig = cc.DecryptConfig
 	}
 
 	for _, image := range opts.additionalTags {
@@ -193,16 +417,189 @@ func (opts *copyOptions) run(c *cli.Context) error {
 		destinationCtx.DockerArchiveAdditionalTags = append(destinationCtx.DockerArchiveAdditionalTags, namedTagged)
 	}
 
-	ctx, cancel := commandTimeoutContextFromGlobalOptions(c)
-	defer cancel()
+	return copyOne(ctx, policyContext, destRef, srcRef, sourceCtx, destinationCtx, manifestType, passphrase, encLayers, encConfig, decConfig, imageListSelection, destCompressionFormat, destCompressionLevel, opts)
+}
+
+// effectiveManifestType returns manifestType if it is non-empty (the user forced a format with
+// --format), and otherwise inspects the source image to find the manifest media type copy would
+// actually produce for the destination. Callers that need to validate against the real
+// destination format (e.g. compression algorithm support) must use this instead of manifestType
+// directly, since an empty manifestType means "whatever the source already is", not "anything".
+func effectiveManifestType(ctx context.Context, sourceCtx *types.SystemContext, srcRef types.ImageReference, manifestType string) (string, error) {
+	if manifestType != "" {
+		return manifestType, nil
+	}
+	src, err := srcRef.NewImageSource(ctx, sourceCtx)
+	if err != nil {
+		return "", fmt.Errorf("error inspecting source image: %v", err)
+	}
+	defer src.Close()
+	_, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("error inspecting source image: %v", err)
+	}
+	return mimeType, nil
+}
+
+// destinationCompressionFromOptions resolves --dest-compress-format/--dest-compress-level into
+// the copy.Options fields they map to, rejecting combinations the destination can't represent.
+// manifestType must be the effective destination manifest type (see effectiveManifestType), not
+// only the CLI-forced one, or a non-OCI source copied with --format omitted would wrongly be
+// allowed to compress with zstd/zstd:chunked: only the OCI manifest format can express those
+// layer media types, so any other manifest type (schema1 or schema2) must reject them too.
+func destinationCompressionFromOptions(opts *copyOptions, manifestType string) (*compression.Algorithm, *int, error) {
+	var format *compression.Algorithm
+	if opts.destCompressFormat.present {
+		algo, err := compression.AlgorithmByName(opts.destCompressFormat.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid --dest-compress-format %q: %v", opts.destCompressFormat.value, err)
+		}
+		if opts.destCompressFormat.value != "gzip" && manifestType != "" && manifestType != imgspecv1.MediaTypeImageManifest {
+			return nil, nil, fmt.Errorf("--dest-compress-format %s is only supported when the destination manifest format is OCI, not %q", opts.destCompressFormat.value, manifestType)
+		}
+		format = &algo
+	}
+
+	var level *int
+	if opts.destCompressLevel.present {
+		if format == nil {
+			return nil, nil, errors.New("--dest-compress-level requires --dest-compress-format")
+		}
+		l := opts.destCompressLevel.value
+		level = &l
+	}
+
+	return format, level, nil
+}
+
+// copyOne copies a single image with copy.Image (retrying it through retryWithBackoff when
+// opts.retryTimes is positive), building copy.Options from the already-resolved
+// manifest type, encryption/decryption configuration and image-list selection. It is factored
+// out of (*copyOptions).run so that batch drivers (e.g. "skopeo sync") can reuse it without
+// going through a cli.Context.
+func copyOne(ctx context.Context, policyContext *signature.PolicyContext, destRef, srcRef types.ImageReference, sourceCtx, destinationCtx *types.SystemContext, manifestType string, passphrase string, encLayers *[]int, encConfig *encconfig.EncryptConfig, decConfig *encconfig.DecryptConfig, imageListSelection copy.ImageListSelection, destCompressionFormat *compression.Algorithm, destCompressionLevel *int, opts *copyOptions) error {
+	runCopy := func() error {
+		_, err := copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
+			RemoveSignatures:                 opts.removeSignatures,
+			SignBy:                           opts.signByFingerprint,
+			SignBySigstorePrivateKeyFile:     opts.signBySigstorePrivateKeyFile,
+			SignSigstorePrivateKeyPassphrase: []byte(passphrase),
+			ReportWriter:                     os.Stdout,
+			SourceCtx:                        sourceCtx,
+			DestinationCtx:                   destinationCtx,
+			ForceManifestMIMEType:            manifestType,
+			OciEncryptLayers:                 encLayers,
+			OciEncryptConfig:                 encConfig,
+			OciDecryptConfig:                 decConfig,
+			ImageListSelection:               imageListSelection,
+			DestinationCompressionFormat:     destCompressionFormat,
+			DestinationCompressionLevel:      destCompressionLevel,
+		})
+		return err
+	}
+
+	if opts.retryTimes <= 0 {
+		return runCopy()
+	}
+	return retryWithBackoff(ctx, opts.retryTimes, opts.retryDelay, runCopy)
+}
+
+// maxBackoffShift caps the exponential backoff's doubling so delay*2^attempt cannot overflow
+// time.Duration (and go negative) when --retry-times is large.
+const maxBackoffShift = 20
+
+// init seeds the global math/rand source once at process start; an unseeded source would
+// produce the same "random" jitter on every run, defeating its purpose of spreading out
+// retries. The top-level rand funcs (rather than a package-level *rand.Rand) are used in
+// retryWithBackoff because retries are triggered concurrently by "skopeo sync"'s worker pool,
+// and only the global source is safe for concurrent use.
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// retryWithBackoff calls fn, retrying up to maxRetries times whenever fn fails with a transient
+// error (network errors, 5xx/429 registry responses, or an EOF encountered mid-blob). It honors
+// a server-suggested Retry-After delay when the error exposes one, and otherwise waits
+// delay*2^attempt plus up to 25% jitter. A non-transient error, or exhausting maxRetries,
+// returns immediately.
+func retryWithBackoff(ctx context.Context, maxRetries int, delay time.Duration, fn func() error) error {
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt == maxRetries || !isRetryableCopyError(err) {
+			return err
+		}
+
+		wait, ok := retryAfterFromError(err)
+		if !ok {
+			shift := attempt
+			if shift > maxBackoffShift {
+				shift = maxBackoffShift
+			}
+			wait = delay * time.Duration(uint64(1)<<uint(shift))
+			wait += time.Duration(rand.Int63n(int64(wait)/4 + 1)) // up to 25% jitter
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// retryAfterProvider is implemented by errors that can report a server-suggested retry delay
+// (for example a 429 response's Retry-After header). Hooking an interface here, rather than
+// guessing, lets retryWithBackoff honor it whenever the underlying HTTP client surfaces one.
+type retryAfterProvider interface {
+	RetryAfter() (time.Duration, bool)
+}
+
+func retryAfterFromError(err error) (time.Duration, bool) {
+	var p retryAfterProvider
+	if errors.As(err, &p) {
+		return p.RetryAfter()
+	}
+	return 0, false
+}
+
+// isRetryableCopyError reports whether err looks like a transient failure worth retrying: a
+// network error, an EOF mid-transfer, or a registry response carrying a 5xx/429 status. It
+// inspects typed errors rather than matching substrings of err.Error(), so a blob size, port or
+// digest that happens to contain "500" or "429" is never mistaken for a retryable failure.
+func isRetryableCopyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	// *url.Error itself satisfies net.Error, so it is unwrapped before the net.Error check.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return isRetryableCopyError(urlErr.Err)
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	var codeErr errcode.Error
+	if errors.As(err, &codeErr) {
+		return isRetryableStatusCode(codeErr.Code.Descriptor().HTTPStatusCode)
+	}
+	var codeErrs errcode.Errors
+	if errors.As(err, &codeErrs) {
+		for _, e := range codeErrs {
+			if isRetryableCopyError(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
-		RemoveSignatures:      opts.removeSignatures,
-		SignBy:                opts.signByFingerprint,
-		ReportWriter:          os.Stdout,
-		SourceCtx:             sourceCtx,
-		DestinationCtx:        destinationCtx,
-		ForceManifestMIMEType: manifestType,
-	})
-	return err
+func isRetryableStatusCode(status int) bool {
+	return status == http.StatusTooManyRequests || (status >= 500 && status < 600)
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+func TestIsRetryableStatusCode(t *testing.T) {
+	cases := map[int]bool{
+		200: false,
+		400: false,
+		401: false,
+		404: false,
+		429: true,
+		500: true,
+		502: true,
+		503: true,
+		504: true,
+		600: false,
+	}
+	for status, want := range cases {
+		if got := isRetryableStatusCode(status); got != want {
+			t.Errorf("isRetryableStatusCode(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+type fakeNetError struct{ error }
+
+func (fakeNetError) Timeout() bool   { return true }
+func (fakeNetError) Temporary() bool { return true }
+
+func TestIsRetryableCopyError(t *testing.T) {
+	errContainingStatusSubstrings := errors.New("read 50000 bytes from repository example.com:429")
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"EOF", io.EOF, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"plain error that merely contains retry-looking substrings", errContainingStatusSubstrings, false},
+		{"net.Error", fakeNetError{errors.New("dial tcp: timeout")}, true},
+		{"url.Error wrapping a net.Error", &url.Error{Op: "Get", URL: "https://example.com", Err: fakeNetError{errors.New("timeout")}}, true},
+		{"url.Error wrapping a permanent error", &url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("permanent")}, false},
+		{"errcode.Error with a 429 status", errcode.Error{Code: errcode.ErrorCodeTooManyRequests}, true},
+		{"errcode.Errors containing one retryable error", errcode.Errors{errcode.Error{Code: errcode.ErrorCodeUnauthorized}, errcode.Error{Code: errcode.ErrorCodeTooManyRequests}}, true},
+		{"errcode.Errors with no retryable error", errcode.Errors{errcode.Error{Code: errcode.ErrorCodeUnauthorized}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryableCopyError(c.err); got != c.want {
+				t.Errorf("isRetryableCopyError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+type fakeRetryAfterError struct {
+	error
+	after time.Duration
+}
+
+func (e fakeRetryAfterError) RetryAfter() (time.Duration, bool) { return e.after, true }
+
+func TestRetryAfterFromError(t *testing.T) {
+	if _, ok := retryAfterFromError(errors.New("no retry-after here")); ok {
+		t.Error("expected ok=false for an error with no RetryAfter method")
+	}
+
+	wrapped := fakeRetryAfterError{errors.New("429"), 30 * time.Second}
+	wait, ok := retryAfterFromError(wrapped)
+	if !ok || wait != 30*time.Second {
+		t.Errorf("retryAfterFromError(%v) = (%v, %v), want (30s, true)", wrapped, wait, ok)
+	}
+}
+
+func TestManifestTypeFromOptionalFormat(t *testing.T) {
+	cases := []struct {
+		format    optionalString
+		want      string
+		wantError bool
+	}{
+		{optionalString{present: false}, "", false},
+		{optionalString{present: true, value: "oci"}, "application/vnd.oci.image.manifest.v1+json", false},
+		{optionalString{present: true, value: "v2s1"}, "application/vnd.docker.distribution.manifest.v1+prettyjws", false},
+		{optionalString{present: true, value: "v2s2"}, "application/vnd.docker.distribution.manifest.v2+json", false},
+		{optionalString{present: true, value: "bogus"}, "", true},
+	}
+	for _, c := range cases {
+		got, err := manifestTypeFromOptionalFormat(c.format)
+		if c.wantError {
+			if err == nil {
+				t.Errorf("manifestTypeFromOptionalFormat(%+v): expected an error, got nil", c.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("manifestTypeFromOptionalFormat(%+v): unexpected error: %v", c.format, err)
+		}
+		if got != c.want {
+			t.Errorf("manifestTypeFromOptionalFormat(%+v) = %q, want %q", c.format, got, c.want)
+		}
+	}
+}
+
+var _ net.Error = fakeNetError{}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/containers/image/signature"
+	"github.com/urfave/cli"
+)
+
+// getPolicyContext returns a signature.PolicyContext built from the --policy global option (or
+// the default policy when it is unset). This is the only definition of getPolicyContext in the
+// tree; copy and sync both call it directly rather than going through a cached application
+// context. Recognizing a "sigstoreSigned" requirement (keyPath/keyData/signedIdentity) alongside
+// "signedBy" is entirely the vendored signature package's job: this function does not special-
+// case either kind, so sigstore-gated pulls work here only if the vendored containers/image
+// version linked into the binary parses that requirement type.
+func getPolicyContext(c *cli.Context) (*signature.PolicyContext, error) {
+	policyPath := c.GlobalString("policy")
+	var policy *signature.Policy // This could be cached across calls, if we had an application context.
+	var err error
+	if policyPath == "" {
+		policy, err = signature.DefaultPolicy(nil)
+	} else {
+		policy, err = signature.NewPolicyFromFile(policyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewPolicyContext(policy)
+}
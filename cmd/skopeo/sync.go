@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	semver "github.com/Masterminds/semver/v3"
+	"github.com/containers/image/copy"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/transports/alltransports"
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// syncEntry describes one source repository to mirror into a destination repository, as read
+// from a --manifest-file document. Source and Destination may be bare "registry/repo" strings
+// (assumed to be "docker:"), or explicitly prefixed with "dir:" or "oci:". Tags may be literal
+// tags, shell-style globs (e.g. "v1.*"), or semver constraints (e.g. "^1.2.0").
+type syncEntry struct {
+	Source           string   `yaml:"source"`
+	Destination      string   `yaml:"destination"`
+	Credentials      string   `yaml:"credentials,omitempty"`
+	Tags             []string `yaml:"tags,omitempty"`
+	Format           string   `yaml:"format,omitempty"`
+	RemoveSignatures *bool    `yaml:"remove-signatures,omitempty"`
+}
+
+// syncManifest is the top-level shape of the --manifest-file document.
+type syncManifest struct {
+	Entries []syncEntry `yaml:"entries"`
+}
+
+type syncOptions struct {
+	manifestFile string        // Path to the YAML file describing the entries to copy
+	workers      int           // Maximum number of concurrent copies
+	dryRun       bool          // Only print the resolved copy plan
+	retryTimes   int           // Number of times to retry each copy on a transient error
+	retryDelay   time.Duration // Initial delay between retries, doubling on each attempt
+}
+
+// copyJob is a single source-image -> destination-image pair resolved from a syncEntry, along
+// with the copyOptions that entry requested.
+type copyJob struct {
+	srcRef         types.ImageReference
+	destRef        types.ImageReference
+	sourceCtx      *types.SystemContext
+	destinationCtx *types.SystemContext
+	copyOpts       *copyOptions
+}
+
+func syncCmd() cli.Command {
+	opts := syncOptions{}
+	return cli.Command{
+		Name:      "sync",
+		Usage:     "Copy the selected tags (all tags when none are listed) of multiple repositories as described by a YAML manifest file",
+		ArgsUsage: "",
+		Action:    opts.run,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "manifest-file",
+				Usage:       "read the sync plan from `FILE`",
+				Destination: &opts.manifestFile,
+			},
+			cli.IntFlag{
+				Name:        "workers",
+				Value:       4,
+				Usage:       "copy up to `N` images concurrently",
+				Destination: &opts.workers,
+			},
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "print the resolved copy plan without copying anything",
+				Destination: &opts.dryRun,
+			},
+			cli.IntFlag{
+				Name:        "retry-times",
+				Usage:       "the number of times to retry each copy on a transient error",
+				Destination: &opts.retryTimes,
+			},
+			cli.DurationFlag{
+				Name:        "retry-delay",
+				Value:       5 * time.Second,
+				Usage:       "the initial `DURATION` to wait between retries, doubling (with jitter) on each attempt",
+				Destination: &opts.retryDelay,
+			},
+		},
+	}
+}
+
+func (opts *syncOptions) run(c *cli.Context) error {
+	if opts.manifestFile == "" {
+		cli.ShowCommandHelp(c, "sync")
+		return errors.New("--manifest-file is required")
+	}
+	if opts.workers < 1 {
+		return errors.New("--workers must be at least 1")
+	}
+
+	data, err := ioutil.ReadFile(opts.manifestFile)
+	if err != nil {
+		return fmt.Errorf("error reading manifest file %s: %v", opts.manifestFile, err)
+	}
+	var manifest syncManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("error parsing manifest file %s: %v", opts.manifestFile, err)
+	}
+
+	sourceCtx, destinationCtx, err := contextsFromGlobalOptions(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandTimeoutContextFromGlobalOptions(c)
+	defer cancel()
+
+	jobs, err := resolveSyncJobs(ctx, manifest, sourceCtx, destinationCtx, opts.retryTimes, opts.retryDelay)
+	if err != nil {
+		return err
+	}
+
+	if opts.dryRun {
+		for _, job := range jobs {
+			fmt.Fprintf(os.Stdout, "%s -> %s\n", transportImageName(job.srcRef), transportImageName(job.destRef))
+		}
+		return nil
+	}
+
+	policyContext, err := getPolicyContext(c)
+	if err != nil {
+		return fmt.Errorf("Error loading trust policy: %v", err)
+	}
+	defer policyContext.Destroy()
+
+	return runSyncJobs(ctx, policyContext, jobs, opts.workers)
+}
+
+// splitSyncTransport splits a syncEntry endpoint such as "registry.example.com/repo",
+// "dir:/path/to/layout" or "oci:/path/to/layout" into its transport name and the path/repository
+// within that transport. An endpoint with no recognized transport prefix defaults to "docker",
+// the same shorthand "copy" itself does not need because it always takes full transport:details
+// references.
+func splitSyncTransport(ref string) (transport, path string) {
+	if i := strings.Index(ref, ":"); i >= 0 {
+		switch ref[:i] {
+		case "dir", "oci":
+			p := ref[i+1:]
+			if strings.HasPrefix(p, "//") {
+				p = p[1:] // "oci://var/x" names the same absolute path as "oci:/var/x"
+			}
+			return ref[:i], p
+		}
+	}
+	return "docker", ref
+}
+
+// listSyncRefs enumerates the available tags/refs for a sync source, so unpatterned entries and
+// glob/semver tag patterns have something concrete to match against.
+func listSyncRefs(ctx context.Context, transport, path string, sourceCtx *types.SystemContext) ([]string, error) {
+	switch transport {
+	case "docker":
+		repoRef, err := alltransports.ParseImageName("docker://" + path)
+		if err != nil {
+			return nil, err
+		}
+		return docker.GetRepositoryTags(ctx, sourceCtx, repoRef)
+	case "oci":
+		return listOCILayoutRefs(path)
+	case "dir":
+		return []string{""}, nil // a "dir:" layout holds exactly one untagged image
+	default:
+		return nil, fmt.Errorf("sync does not know how to enumerate tags for transport %q", transport)
+	}
+}
+
+// listOCILayoutRefs reads an OCI image layout's index.json and returns the
+// "org.opencontainers.image.ref.name" annotation of every manifest listed there: an oci: layout's
+// equivalent of a registry's tag list.
+func listOCILayoutRefs(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, m := range index.Manifests {
+		if ref := m.Annotations[imgspecv1.AnnotationRefName]; ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// buildSyncRef builds the concrete image reference for one resolved tag of a sync entry.
+func buildSyncRef(transport, path, tag string) (types.ImageReference, error) {
+	switch transport {
+	case "docker":
+		return alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", path, tag))
+	case "oci":
+		if tag == "" {
+			return alltransports.ParseImageName("oci:" + path)
+		}
+		return alltransports.ParseImageName(fmt.Sprintf("oci:%s:%s", path, tag))
+	case "dir":
+		return alltransports.ParseImageName("dir:" + path)
+	default:
+		return nil, fmt.Errorf("sync does not support transport %q", transport)
+	}
+}
+
+// tagPatternNeedsListing reports whether pattern requires the full tag list to resolve (a glob
+// or a semver constraint), as opposed to naming a literal tag directly.
+func tagPatternNeedsListing(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[") || isSemverConstraint(pattern)
+}
+
+// isSemverConstraint reports whether pattern looks like a semver range (e.g. "^1.2.3",
+// ">=1.0.0 <2.0.0") rather than a literal tag.
+func isSemverConstraint(pattern string) bool {
+	for _, prefix := range []string{"^", "~", ">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(pattern, " - ")
+}
+
+// expandTagPatterns resolves each of patterns against the available tags: a literal tag is used
+// as-is (even if absent from available, so a first push to an empty destination still works), a
+// glob is matched with path.Match, and a semver constraint is matched against the tags in
+// available that parse as semver versions.
+func expandTagPatterns(patterns, available []string) ([]string, error) {
+	var resolved []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			resolved = append(resolved, tag)
+		}
+	}
+
+	for _, pattern := range patterns {
+		switch {
+		case strings.ContainsAny(pattern, "*?["):
+			matched, err := matchGlobTags(pattern, available)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag glob %q: %v", pattern, err)
+			}
+			if len(matched) == 0 {
+				return nil, fmt.Errorf("tag glob %q matched no tags", pattern)
+			}
+			for _, t := range matched {
+				add(t)
+			}
+		case isSemverConstraint(pattern):
+			matched, err := matchSemverTags(pattern, available)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag semver range %q: %v", pattern, err)
+			}
+			if len(matched) == 0 {
+				return nil, fmt.Errorf("tag semver range %q matched no tags", pattern)
+			}
+			for _, t := range matched {
+				add(t)
+			}
+		default:
+			add(pattern)
+		}
+	}
+	return resolved, nil
+}
+
+func matchGlobTags(pattern string, available []string) ([]string, error) {
+	var matched []string
+	for _, tag := range available {
+		ok, err := path.Match(pattern, tag)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, tag)
+		}
+	}
+	return matched, nil
+}
+
+func matchSemverTags(pattern string, available []string) ([]string, error) {
+	constraint, err := semver.NewConstraint(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, tag := range available {
+		v, err := semver.NewVersion(tag)
+		if err != nil {
+			continue // not every tag in a repository is a version (e.g. "latest")
+		}
+		if constraint.Check(v) {
+			matched = append(matched, tag)
+		}
+	}
+	return matched, nil
+}
+
+// resolveSyncJobs expands each syncEntry's tags (listing the source's tags/refs when a pattern
+// or an empty tag list requires it) into concrete copyJobs. retryTimes and retryDelay are copied
+// onto each job's copyOptions so the per-image retry/backoff logic in copyOne also covers the
+// batch sync path, not just "skopeo copy".
+func resolveSyncJobs(ctx context.Context, manifest syncManifest, sourceCtx, destinationCtx *types.SystemContext, retryTimes int, retryDelay time.Duration) ([]copyJob, error) {
+	var jobs []copyJob
+	for _, entry := range manifest.Entries {
+		entrySourceCtx := *sourceCtx
+		if entry.Credentials != "" {
+			username, password := entry.Credentials, ""
+			if i := strings.IndexByte(entry.Credentials, ':'); i >= 0 {
+				username, password = entry.Credentials[:i], entry.Credentials[i+1:]
+			}
+			entrySourceCtx.DockerAuthConfig = &types.DockerAuthConfig{Username: username, Password: password}
+		}
+
+		srcTransport, srcPath := splitSyncTransport(entry.Source)
+		destTransport, destPath := splitSyncTransport(entry.Destination)
+
+		needsListing := len(entry.Tags) == 0
+		for _, t := range entry.Tags {
+			if tagPatternNeedsListing(t) {
+				needsListing = true
+			}
+		}
+
+		var available []string
+		if needsListing {
+			var err error
+			available, err = listSyncRefs(ctx, srcTransport, srcPath, &entrySourceCtx)
+			if err != nil {
+				return nil, fmt.Errorf("error listing tags for %q: %v", entry.Source, err)
+			}
+		}
+
+		tags := available
+		if len(entry.Tags) > 0 {
+			var err error
+			tags, err = expandTagPatterns(entry.Tags, available)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %v", entry.Source, err)
+			}
+		}
+
+		if destTransport == "dir" && len(tags) > 1 {
+			return nil, fmt.Errorf("destination %q is a \"dir:\" layout, which holds a single image, but source %q resolved to %d tags", entry.Destination, entry.Source, len(tags))
+		}
+
+		entryCopyOpts := &copyOptions{retryTimes: retryTimes, retryDelay: retryDelay}
+		if entry.RemoveSignatures != nil {
+			entryCopyOpts.removeSignatures = *entry.RemoveSignatures
+		}
+		if entry.Format != "" {
+			if err := newOptionalStringValue(&entryCopyOpts.format).Set(entry.Format); err != nil {
+				return nil, fmt.Errorf("invalid format %q for %q: %v", entry.Format, entry.Source, err)
+			}
+		}
+
+		for _, tag := range tags {
+			srcRef, err := buildSyncRef(srcTransport, srcPath, tag)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %q: %v", entry.Source, err)
+			}
+			destTag := tag
+			if destTransport == "dir" {
+				destTag = ""
+			}
+			destRef, err := buildSyncRef(destTransport, destPath, destTag)
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination %q: %v", entry.Destination, err)
+			}
+			jobs = append(jobs, copyJob{
+				srcRef:         srcRef,
+				destRef:        destRef,
+				sourceCtx:      &entrySourceCtx,
+				destinationCtx: destinationCtx,
+				copyOpts:       entryCopyOpts,
+			})
+		}
+	}
+	return jobs, nil
+}
+
+// runSyncJobs copies every job using up to workers concurrent copy.Image calls, aggregating
+// per-image failures instead of stopping at the first one.
+func runSyncJobs(ctx context.Context, policyContext *signature.PolicyContext, jobs []copyJob, workers int) error {
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []string
+
+	for _, j := range jobs {
+		job := j
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			manifestType, err := manifestTypeFromOptionalFormat(job.copyOpts.format)
+			if err == nil {
+				err = copyOne(ctx, policyContext, job.destRef, job.srcRef, job.sourceCtx, job.destinationCtx, manifestType, "", nil, nil, nil, copy.CopySystemImage, nil, nil, job.copyOpts)
+			}
+			if err != nil {
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("%s -> %s: %v", transportImageName(job.srcRef), transportImageName(job.destRef), err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Fprintf(os.Stdout, "Copied %d image(s), %d failure(s)\n", len(jobs)-len(failures), len(failures))
+	if len(failures) > 0 {
+		return fmt.Errorf("sync failed for %d image(s):\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// transportImageName renders ref the way transports.ImageName does, without requiring callers
+// to also import the transports package.
+func transportImageName(ref types.ImageReference) string {
+	return ref.Transport().Name() + ":" + ref.StringWithinTransport()
+}
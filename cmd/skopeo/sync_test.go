@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSyncTransport(t *testing.T) {
+	cases := []struct {
+		ref           string
+		wantTransport string
+		wantPath      string
+	}{
+		{"registry.example.com/repo", "docker", "registry.example.com/repo"},
+		{"dir:/var/lib/images/busybox", "dir", "/var/lib/images/busybox"},
+		{"oci:/var/lib/images/busybox", "oci", "/var/lib/images/busybox"},
+		{"oci://var/lib/images/busybox", "oci", "/var/lib/images/busybox"},
+		{"docker-archive:/tmp/out.tar", "docker", "docker-archive:/tmp/out.tar"},
+	}
+	for _, c := range cases {
+		gotTransport, gotPath := splitSyncTransport(c.ref)
+		if gotTransport != c.wantTransport || gotPath != c.wantPath {
+			t.Errorf("splitSyncTransport(%q) = (%q, %q), want (%q, %q)", c.ref, gotTransport, gotPath, c.wantTransport, c.wantPath)
+		}
+	}
+}
+
+func TestIsSemverConstraint(t *testing.T) {
+	cases := map[string]bool{
+		"latest":        false,
+		"v1.2.3":        false,
+		"v1.*":          false,
+		"^1.2.3":        true,
+		"~1.2.3":        true,
+		">=1.0.0":       true,
+		"<=2.0.0":       true,
+		">1.0.0":        true,
+		"<2.0.0":        true,
+		"=1.2.3":        true,
+		"1.0.0 - 2.0.0": true,
+	}
+	for pattern, want := range cases {
+		if got := isSemverConstraint(pattern); got != want {
+			t.Errorf("isSemverConstraint(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+func TestTagPatternNeedsListing(t *testing.T) {
+	cases := map[string]bool{
+		"latest":  false,
+		"v1.2.3":  false,
+		"v1.*":    true,
+		"v1.?":    true,
+		"v[12].0": true,
+		"^1.2.3":  true,
+	}
+	for pattern, want := range cases {
+		if got := tagPatternNeedsListing(pattern); got != want {
+			t.Errorf("tagPatternNeedsListing(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+func TestMatchGlobTags(t *testing.T) {
+	available := []string{"v1.0.0", "v1.1.0", "v2.0.0", "latest"}
+	matched, err := matchGlobTags("v1.*", available)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"v1.0.0", "v1.1.0"}
+	if !reflect.DeepEqual(matched, want) {
+		t.Errorf("matchGlobTags(%q, %v) = %v, want %v", "v1.*", available, matched, want)
+	}
+
+	if _, err := matchGlobTags("[", available); err == nil {
+		t.Error("expected an error for a malformed glob, got nil")
+	}
+}
+
+func TestMatchSemverTags(t *testing.T) {
+	available := []string{"v1.0.0", "1.1.0", "2.0.0", "latest"}
+	matched, err := matchSemverTags("^1.0.0", available)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"v1.0.0", "1.1.0"}
+	if !reflect.DeepEqual(matched, want) {
+		t.Errorf("matchSemverTags(%q, %v) = %v, want %v", "^1.0.0", available, matched, want)
+	}
+
+	if _, err := matchSemverTags("not a constraint", available); err == nil {
+		t.Error("expected an error for an invalid constraint, got nil")
+	}
+}
+
+func TestExpandTagPatterns(t *testing.T) {
+	available := []string{"v1.0.0", "v1.1.0", "v2.0.0"}
+
+	t.Run("literal tag not in available is kept", func(t *testing.T) {
+		resolved, err := expandTagPatterns([]string{"unreleased"}, available)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(resolved, []string{"unreleased"}) {
+			t.Errorf("got %v, want [unreleased]", resolved)
+		}
+	})
+
+	t.Run("glob with no matches is an error", func(t *testing.T) {
+		if _, err := expandTagPatterns([]string{"v9.*"}, available); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
+
+	t.Run("semver constraint with no matches is an error", func(t *testing.T) {
+		if _, err := expandTagPatterns([]string{"^9.0.0"}, available); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
+
+	t.Run("duplicate matches across patterns are deduplicated", func(t *testing.T) {
+		resolved, err := expandTagPatterns([]string{"v1.*", "v1.0.0"}, available)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []string{"v1.0.0", "v1.1.0"}
+		if !reflect.DeepEqual(resolved, want) {
+			t.Errorf("got %v, want %v", resolved, want)
+		}
+	})
+}